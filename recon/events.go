@@ -0,0 +1,132 @@
+package recon
+
+import "sync"
+
+// EventType identifies the kind of change an Event describes.
+type EventType int
+
+const (
+	Inserted EventType = iota
+	Removed
+	Split
+	Joined
+	ReconStarted
+	ReconFinished
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Inserted:
+		return "Inserted"
+	case Removed:
+		return "Removed"
+	case Split:
+		return "Split"
+	case Joined:
+		return "Joined"
+	case ReconStarted:
+		return "ReconStarted"
+	case ReconFinished:
+		return "ReconFinished"
+	}
+	return "Unknown"
+}
+
+// Event describes a single committed tree mutation or recon round.
+// Only the fields relevant to Type are populated.
+type Event struct {
+	Type EventType
+
+	Element *Zp       // Inserted, Removed
+	Node    *Bitstring // Split, Joined: key of the node that changed shape
+
+	Partner string // ReconStarted, ReconFinished
+	Added   int    // ReconFinished: elements inserted as a result of the round
+	Removed int    // ReconFinished: elements removed as a result of the round
+	Err     error  // ReconFinished: non-nil if the round failed
+}
+
+// CancelFunc unsubscribes the channel it was returned alongside, and
+// is safe to call more than once or from any goroutine.
+type CancelFunc func()
+
+// subscriberBufferSize bounds each subscriber's event channel. A slow
+// subscriber drops its oldest buffered event rather than blocking the
+// tree mutation that's publishing.
+const subscriberBufferSize = 256
+
+type subscriber struct {
+	ch chan Event
+}
+
+// send delivers e to the subscriber, dropping the oldest buffered
+// event first if the channel is full.
+func (s *subscriber) send(e Event) {
+	select {
+	case s.ch <- e:
+		return
+	default:
+	}
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- e:
+	default:
+	}
+}
+
+// eventBroker implements the publish side of PrefixTree's Subscribe
+// API. MemPrefixTree and BoltPrefixTree each embed one.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+	published   uint64
+}
+
+// Subscribe returns a channel of Events and a CancelFunc to stop
+// receiving them. The channel is never closed except by calling
+// CancelFunc, so a range over it blocks until cancellation.
+func (b *eventBroker) Subscribe() (<-chan Event, CancelFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*subscriber]bool)
+	}
+	sub := &subscriber{ch: make(chan Event, subscriberBufferSize)}
+	b.subscribers[sub] = true
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, CancelFunc(cancel)
+}
+
+// publish fans e out to every current subscriber. Callers must only
+// publish after the mutation e describes has committed.
+func (b *eventBroker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published++
+	for sub := range b.subscribers {
+		sub.send(e)
+	}
+}
+
+// EventCount returns the total number of events published so far,
+// regardless of whether subscribers received or dropped them. It's a
+// cheap way for a caller holding the tree (not a subscription) to poll
+// for activity. It isn't reported through the Metrics interface, and
+// events dropped from a full subscriber buffer are not counted
+// separately.
+func (b *eventBroker) EventCount() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published
+}
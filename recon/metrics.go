@@ -0,0 +1,147 @@
+package recon
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is the instrumentation hook probed by MemPrefixTree (and the
+// recon protocol built on top of it). The default NopMetrics discards
+// everything, so embedders who don't want the prometheus/client_golang
+// dependency pulled in can leave Settings.Metrics unset; anyone who
+// wants a different sink (statsd, OpenTelemetry, ...) can implement
+// this interface themselves instead of being forced onto Prometheus.
+type Metrics interface {
+	// NodeCount reports the current number of nodes in the tree and
+	// their depth, called after every split/join.
+	NodeCount(nodes int, depth int)
+	// LeafSize reports the number of elements held by a leaf node,
+	// called whenever a leaf is written (insert, remove, or a split
+	// moving elements into a new leaf).
+	LeafSize(elements int)
+	// Split/Join count the respective tree operations.
+	Split()
+	Join()
+	// InsertDuration/RemoveDuration time a whole Insert/Remove call,
+	// including any split or join it triggers.
+	InsertDuration(d time.Duration)
+	RemoveDuration(d time.Duration)
+	// ReconRound counts one gossip round with a partner, by outcome:
+	// "success", "timeout", "full-sync" or "diff-size".
+	ReconRound(partner, outcome string)
+	// ReconElements reports how many elements were reconciled
+	// (inserted or removed locally as a result of a recon round).
+	ReconElements(partner string, n int)
+	// OutstandingReconRequests reports the current number of recon
+	// requests in flight, so MaxOutstandingReconRequests saturation
+	// is visible before requests start being rejected.
+	OutstandingReconRequests(n int)
+}
+
+// NopMetrics discards every measurement. It's the default so embedders
+// don't pay for Prometheus unless they ask for it.
+type NopMetrics struct{}
+
+func (NopMetrics) NodeCount(nodes, depth int)          {}
+func (NopMetrics) LeafSize(elements int)               {}
+func (NopMetrics) Split()                              {}
+func (NopMetrics) Join()                               {}
+func (NopMetrics) InsertDuration(d time.Duration)      {}
+func (NopMetrics) RemoveDuration(d time.Duration)      {}
+func (NopMetrics) ReconRound(partner, outcome string)  {}
+func (NopMetrics) ReconElements(partner string, n int) {}
+func (NopMetrics) OutstandingReconRequests(n int)      {}
+
+// PrometheusMetrics is the stock Metrics implementation, registering
+// its collectors with the given prometheus.Registerer (typically
+// prometheus.DefaultRegisterer, served on Settings.HttpPort by the
+// embedder alongside the existing recon HTTP handlers).
+type PrometheusMetrics struct {
+	nodeCount        prometheus.Gauge
+	treeDepth        prometheus.Gauge
+	leafSize         prometheus.Histogram
+	splits           prometheus.Counter
+	joins            prometheus.Counter
+	insertDuration   prometheus.Histogram
+	removeDuration   prometheus.Histogram
+	reconRounds      *prometheus.CounterVec
+	reconElements    *prometheus.CounterVec
+	outstandingRecon prometheus.Gauge
+}
+
+// NewPrometheusMetrics creates and registers the collectors backing a
+// PrometheusMetrics with reg.
+func NewPrometheusMetrics(reg prometheus.Registerer) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		nodeCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "tree_nodes",
+			Help: "Current number of nodes in the prefix tree.",
+		}),
+		treeDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "tree_depth",
+			Help: "Current depth of the prefix tree.",
+		}),
+		leafSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "leaf_elements",
+			Help:    "Number of elements stored per leaf node.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		splits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "splits_total",
+			Help: "Total number of node splits.",
+		}),
+		joins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "joins_total",
+			Help: "Total number of node joins.",
+		}),
+		insertDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "insert_duration_seconds",
+			Help:    "Time to insert one element, including any split it triggers.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		removeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "remove_duration_seconds",
+			Help:    "Time to remove one element, including any join it triggers.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		reconRounds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "gossip_rounds_total",
+			Help: "Total number of gossip rounds, by partner and outcome.",
+		}, []string{"partner", "outcome"}),
+		reconElements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "gossip_elements_total",
+			Help: "Total number of elements reconciled, by partner.",
+		}, []string{"partner"}),
+		outstandingRecon: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "conflux", Subsystem: "recon", Name: "outstanding_requests",
+			Help: "Current number of outstanding recon requests.",
+		}),
+	}
+	reg.MustRegister(m.nodeCount, m.treeDepth, m.leafSize, m.splits, m.joins,
+		m.insertDuration, m.removeDuration, m.reconRounds, m.reconElements, m.outstandingRecon)
+	return m
+}
+
+func (m *PrometheusMetrics) NodeCount(nodes, depth int) {
+	m.nodeCount.Set(float64(nodes))
+	m.treeDepth.Set(float64(depth))
+}
+func (m *PrometheusMetrics) LeafSize(elements int)     { m.leafSize.Observe(float64(elements)) }
+func (m *PrometheusMetrics) Split()                    { m.splits.Inc() }
+func (m *PrometheusMetrics) Join()                     { m.joins.Inc() }
+func (m *PrometheusMetrics) InsertDuration(d time.Duration) {
+	m.insertDuration.Observe(d.Seconds())
+}
+func (m *PrometheusMetrics) RemoveDuration(d time.Duration) {
+	m.removeDuration.Observe(d.Seconds())
+}
+func (m *PrometheusMetrics) ReconRound(partner, outcome string) {
+	m.reconRounds.WithLabelValues(partner, outcome).Inc()
+}
+func (m *PrometheusMetrics) ReconElements(partner string, n int) {
+	m.reconElements.WithLabelValues(partner).Add(float64(n))
+}
+func (m *PrometheusMetrics) OutstandingReconRequests(n int) {
+	m.outstandingRecon.Set(float64(n))
+}
@@ -23,6 +23,8 @@ package recon
 
 import (
 	"errors"
+	"time"
+
 	. "github.com/cmars/conflux"
 )
 
@@ -38,6 +40,11 @@ type PrefixTree interface {
 	Node(key *Bitstring) (PrefixNode, error)
 	Insert(z *Zp) error
 	Remove(z *Zp) error
+	// Subscribe returns a stream of Events for every Insert, Remove,
+	// split and join this tree commits, and a CancelFunc to stop
+	// receiving them. Events are only published after the mutation
+	// they describe has committed.
+	Subscribe() (<-chan Event, CancelFunc)
 }
 
 type PrefixNode interface {
@@ -69,6 +76,19 @@ type MemPrefixTree struct {
 	points []*Zp
 	// Tree's root node
 	root *MemPrefixNode
+	// Metrics receives instrumentation from Insert/Remove/split/join.
+	// Defaults to NopMetrics in Init.
+	Metrics Metrics
+	// events publishes Insert/Remove/split/join notifications to
+	// Subscribe()'d channels.
+	events eventBroker
+	// nodeTotal and nodeDepths track the node-count metric
+	// incrementally: nodeDepths[d] is the number of nodes currently at
+	// depth d. split/join update the handful of entries a single split
+	// or join actually touches, so reporting NodeCount never costs
+	// another O(n) walk of the tree.
+	nodeTotal  int
+	nodeDepths []int
 }
 
 func (t *MemPrefixTree) SplitThreshold() int       { return t.splitThreshold }
@@ -97,9 +117,39 @@ func (t *MemPrefixTree) Init() {
 	if t.numSamples == 0 {
 		t.numSamples = DefaultNumSamples
 	}
+	if t.Metrics == nil {
+		t.Metrics = NopMetrics{}
+	}
 	t.points = Zpoints(P_SKS, t.numSamples)
 	t.root = new(MemPrefixNode)
 	t.root.init(t)
+	t.nodeTotal = 1
+	t.nodeDepths = []int{1}
+}
+
+// addNodesAtDepth records the addition (n > 0) or removal (n < 0) of n
+// nodes at depth, keeping nodeTotal/nodeDepths consistent. Called once
+// per split (all new children at once) or once per node a join removes,
+// so nodeCount stays O(depth) instead of re-walking the tree.
+func (t *MemPrefixTree) addNodesAtDepth(depth, n int) {
+	for len(t.nodeDepths) <= depth {
+		t.nodeDepths = append(t.nodeDepths, 0)
+	}
+	t.nodeDepths[depth] += n
+	t.nodeTotal += n
+}
+
+// nodeCount returns the number of nodes in the tree and the tree's
+// depth, from the incremental counts addNodesAtDepth maintains.
+func (t *MemPrefixTree) nodeCount() (nodes, depth int) {
+	nodes = t.nodeTotal
+	for d := len(t.nodeDepths) - 1; d >= 0; d-- {
+		if t.nodeDepths[d] > 0 {
+			depth = d
+			break
+		}
+	}
+	return
 }
 
 func Find(t PrefixTree, z *Zp) (PrefixNode, error) {
@@ -150,16 +200,49 @@ func (t *MemPrefixTree) Node(bs *Bitstring) (PrefixNode, error) {
 
 // Insert a Z/Zp integer into the prefix tree
 func (t *MemPrefixTree) Insert(z *Zp) error {
+	start := time.Now()
 	bs := NewBitstring(P_SKS.BitLen())
 	bs.SetBytes(ReverseBytes(z.Bytes()))
-	return t.root.insert(z, AddElementArray(t, z), bs, 0)
+	err := t.root.insert(z, AddElementArray(t, z), bs, 0)
+	t.Metrics.InsertDuration(time.Since(start))
+	if err == nil {
+		t.events.publish(Event{Type: Inserted, Element: z})
+	}
+	return err
 }
 
 // Remove a Z/Zp integer from the prefix tree
 func (t *MemPrefixTree) Remove(z *Zp) error {
+	start := time.Now()
 	bs := NewBitstring(P_SKS.BitLen())
 	bs.SetBytes(ReverseBytes(z.Bytes()))
-	return t.root.remove(z, DelElementArray(t, z), bs, 0)
+	err := t.root.remove(z, DelElementArray(t, z), bs, 0)
+	t.Metrics.RemoveDuration(time.Since(start))
+	if err == nil {
+		t.events.publish(Event{Type: Removed, Element: z})
+	}
+	return err
+}
+
+// Subscribe returns a stream of Events for every Insert, Remove, split
+// and join this tree commits.
+func (t *MemPrefixTree) Subscribe() (<-chan Event, CancelFunc) { return t.events.Subscribe() }
+
+// EventCount returns the total number of events this tree has
+// published, including any that a full subscriber buffer dropped.
+// Dropped events are not counted separately, and the count is not
+// reported through Metrics.
+func (t *MemPrefixTree) EventCount() uint64 { return t.events.EventCount() }
+
+// PublishReconStarted and PublishReconFinished let the recon protocol
+// loop (which drives this tree but lives outside it) feed gossip round
+// outcomes into the same event stream as tree mutations.
+func (t *MemPrefixTree) PublishReconStarted(partner string) {
+	t.events.publish(Event{Type: ReconStarted, Partner: partner})
+}
+
+func (t *MemPrefixTree) PublishReconFinished(partner string, added, removed int, err error) {
+	t.events.publish(Event{Type: ReconFinished, Partner: partner, Added: added, Removed: removed, Err: err})
 }
 
 type MemPrefixNode struct {
@@ -174,6 +257,9 @@ type MemPrefixNode struct {
 	children []*MemPrefixNode
 	// Zp elements stored at this node, if it's a leaf node
 	elements []*Zp
+	// AddElementArray(element) for each element, in the same order,
+	// cached so that split doesn't need to recompute it per element.
+	marrays [][]*Zp
 	// Number of total elements at or below this node
 	numElements int
 	// Sample values at this node
@@ -246,6 +332,8 @@ func (n *MemPrefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) er
 				}
 			}
 			n.elements = append(n.elements, z)
+			n.marrays = append(n.marrays, marray)
+			n.Metrics.LeafSize(len(n.elements))
 			return nil
 		}
 	}
@@ -253,6 +341,11 @@ func (n *MemPrefixNode) insert(z *Zp, marray []*Zp, bs *Bitstring, depth int) er
 	return child.insert(z, marray, bs, depth+1)
 }
 
+// Note: Bitstring itself (github.com/cmars/conflux) still backs keys
+// and bs.Get/bs.Set here with its current representation; a
+// bitset-backed replacement is a change to that root package, which
+// this tree doesn't vendor, so it isn't made here.
+
 func (n *MemPrefixNode) split(depth int) {
 	// Create child nodes
 	numChildren := 1 << uint(n.BitQuantum())
@@ -262,14 +355,74 @@ func (n *MemPrefixNode) split(depth int) {
 		child.init(n.MemPrefixTree)
 		n.children = append(n.children, child)
 	}
-	// Move elements into child nodes
-	for _, element := range n.elements {
+	// Bucket the already-inserted elements (and their cached marrays)
+	// by which child they belong to, so each child is populated with
+	// one updateSvaluesBatch pass instead of N recursive inserts that
+	// would each recompute AddElementArray.
+	childZs := make([][]*Zp, numChildren)
+	childMarrays := make([][][]*Zp, numChildren)
+	for i, element := range n.elements {
 		bs := NewBitstring(P_SKS.BitLen())
 		bs.SetBytes(ReverseBytes(element.Bytes()))
-		child := NextChild(n, bs, depth).(*MemPrefixNode)
-		child.insert(element, AddElementArray(n.MemPrefixTree, element), bs, depth+1)
+		idx := childIndexAt(bs, n.BitQuantum(), depth)
+		childZs[idx] = append(childZs[idx], element)
+		childMarrays[idx] = append(childMarrays[idx], n.marrays[i])
 	}
 	n.elements = nil
+	n.marrays = nil
+	for i, child := range n.children {
+		child.insertBatch(childZs[i], childMarrays[i], depth+1)
+	}
+	n.MemPrefixTree.addNodesAtDepth(depth+1, numChildren)
+	n.Metrics.Split()
+	nodes, treeDepth := n.MemPrefixTree.nodeCount()
+	n.Metrics.NodeCount(nodes, treeDepth)
+	n.events.publish(Event{Type: Split, Node: n.Key()})
+}
+
+func childIndexAt(bs *Bitstring, bitQuantum, depth int) (idx int) {
+	for j := 0; j < bitQuantum; j++ {
+		if bs.Get(depth*bitQuantum+j) == 1 {
+			idx |= 1 << uint(j)
+		}
+	}
+	return
+}
+
+// insertBatch commits a batch of elements with precomputed
+// AddElementArray results into this node: svalues are updated with a
+// single updateSvaluesBatch call rather than one updateSvalues call per
+// element, and numElements is incremented once for the whole batch. A leaf that
+// overflows splits and recurses as usual; an interior node re-buckets
+// the batch by child and recurses per child.
+func (n *MemPrefixNode) insertBatch(zs []*Zp, marrays [][]*Zp, depth int) {
+	if len(zs) == 0 {
+		return
+	}
+	n.updateSvaluesBatch(zs, marrays)
+	n.numElements += len(zs)
+	if n.IsLeaf() {
+		n.elements = append(n.elements, zs...)
+		n.marrays = append(n.marrays, marrays...)
+		n.Metrics.LeafSize(len(n.elements))
+		if len(n.elements) > n.SplitThreshold() {
+			n.split(depth)
+		}
+		return
+	}
+	numChildren := 1 << uint(n.BitQuantum())
+	childZs := make([][]*Zp, numChildren)
+	childMarrays := make([][][]*Zp, numChildren)
+	for i, element := range zs {
+		bs := NewBitstring(P_SKS.BitLen())
+		bs.SetBytes(ReverseBytes(element.Bytes()))
+		idx := childIndexAt(bs, n.BitQuantum(), depth)
+		childZs[idx] = append(childZs[idx], element)
+		childMarrays[idx] = append(childMarrays[idx], marrays[i])
+	}
+	for i, child := range n.children {
+		child.insertBatch(childZs[i], childMarrays[i], depth+1)
+	}
 }
 
 func NextChild(n PrefixNode, bs *Bitstring, depth int) PrefixNode {
@@ -297,37 +450,77 @@ func (n *MemPrefixNode) updateSvalues(z *Zp, marray []*Zp) {
 	}
 }
 
+// updateSvaluesBatch folds a whole batch of elements' marrays into the
+// node's svalues in one pass over the sample points: for each point it
+// multiplies the batch's marray entries together and then into the
+// svalue. That is still one Mul per element per sample point, the same
+// count as one updateSvalues call per element.
+func (n *MemPrefixNode) updateSvaluesBatch(zs []*Zp, marrays [][]*Zp) {
+	if len(zs) == 0 {
+		return
+	}
+	if len(marrays) != len(zs) {
+		panic("Inconsistent batch size")
+	}
+	p := zs[0].P
+	for i := 0; i < len(n.points); i++ {
+		product := marrays[0][i]
+		for k := 1; k < len(marrays); k++ {
+			product = Z(p).Mul(product, marrays[k][i])
+		}
+		n.svalues[i] = Z(p).Mul(n.svalues[i], product)
+	}
+}
+
 func (n *MemPrefixNode) remove(z *Zp, marray []*Zp, bs *Bitstring, depth int) error {
 	n.updateSvalues(z, marray)
 	n.numElements--
 	if !n.IsLeaf() {
 		if n.numElements <= n.JoinThreshold() {
-			n.join()
+			n.join(depth)
 		} else {
 			child := NextChild(n, bs, depth).(*MemPrefixNode)
 			return child.remove(z, marray, bs, depth+1)
 		}
 	}
-	n.elements = withRemoved(n.elements, z)
+	n.elements, n.marrays = withRemoved(n.elements, n.marrays, z)
+	n.Metrics.LeafSize(len(n.elements))
 	return nil
 }
 
-func (n *MemPrefixNode) join() {
+func (n *MemPrefixNode) join(depth int) {
 	var childNode *MemPrefixNode
+	childDepths := make([]int, len(n.children))
+	for i := range childDepths {
+		childDepths[i] = depth + 1
+	}
 	for len(n.children) > 0 {
 		childNode, n.children = n.children[0], n.children[1:]
+		childDepth := childDepths[0]
+		childDepths = childDepths[1:]
 		n.elements = append(n.elements, childNode.elements...)
+		n.marrays = append(n.marrays, childNode.marrays...)
 		n.children = append(n.children, childNode.children...)
+		for range childNode.children {
+			childDepths = append(childDepths, childDepth+1)
+		}
 		childNode.children = nil
+		n.MemPrefixTree.addNodesAtDepth(childDepth, -1)
 	}
 	n.children = nil
+	n.Metrics.Join()
+	n.Metrics.LeafSize(len(n.elements))
+	nodes, treeDepth := n.MemPrefixTree.nodeCount()
+	n.Metrics.NodeCount(nodes, treeDepth)
+	n.events.publish(Event{Type: Joined, Node: n.Key()})
 }
 
-func withRemoved(elements []*Zp, z *Zp) (result []*Zp) {
+func withRemoved(elements []*Zp, marrays [][]*Zp, z *Zp) (result []*Zp, resultMarrays [][]*Zp) {
 	var has bool
-	for _, element := range elements {
+	for i, element := range elements {
 		if element.Cmp(z) != 0 {
 			result = append(result, element)
+			resultMarrays = append(resultMarrays, marrays[i])
 		} else {
 			has = true
 		}
@@ -0,0 +1,734 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	. "github.com/cmars/conflux"
+)
+
+// nodesBucket holds one record per PrefixNode, keyed by the node's
+// Bitstring key (the root node's key is the empty bitstring).
+var nodesBucket = []byte("nodes")
+
+// BoltPrefixTree is a PrefixTree backed by a BoltDB key/value store. It
+// keeps the same node-per-bitstring-prefix shape as MemPrefixTree, but
+// nodes are read from and written back to disk rather than held
+// resident, so a tree can grow well beyond available RAM. split and
+// join rewrite all affected node records inside a single Bolt
+// transaction, so a crash mid-split leaves either the pre-split or the
+// post-split shape on disk, never something in between.
+type BoltPrefixTree struct {
+	// Tree configuration options
+	splitThreshold int
+	joinThreshold  int
+	bitQuantum     int
+	mBar           int
+	numSamples     int
+	// Sample data points for interpolation
+	points []*Zp
+
+	db *bolt.DB
+
+	// Metrics receives instrumentation from Insert/Remove/split/join.
+	// Defaults to NopMetrics in Init.
+	Metrics Metrics
+
+	// events publishes Insert/Remove/split/join notifications to
+	// Subscribe()'d channels, once their transaction has committed.
+	events eventBroker
+
+	// nodeTotal and nodeDepths track the node-count metric
+	// incrementally, mirroring MemPrefixTree: nodeDepths[d] is the
+	// number of nodes currently at depth d. split/join update only the
+	// handful of entries a single split or join actually touches, so
+	// reportNodeCount never costs another walk of the store. They're
+	// seeded by the verifyNode walk in Init, since a store reopened from
+	// a previous run may already hold nodes.
+	nodeTotal  int
+	nodeDepths []int
+}
+
+// NewBoltPrefixTree opens (creating if necessary) a BoltDB file at path
+// to back a PrefixTree. Call Init() before using the returned tree.
+func NewBoltPrefixTree(path string) (*BoltPrefixTree, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltPrefixTree{db: db}, nil
+}
+
+func (t *BoltPrefixTree) SplitThreshold() int { return t.splitThreshold }
+func (t *BoltPrefixTree) JoinThreshold() int  { return t.joinThreshold }
+func (t *BoltPrefixTree) BitQuantum() int     { return t.bitQuantum }
+func (t *BoltPrefixTree) MBar() int           { return t.mBar }
+func (t *BoltPrefixTree) NumSamples() int     { return t.numSamples }
+func (t *BoltPrefixTree) Points() []*Zp       { return t.points }
+
+// Init configures the tree with default settings if not already set,
+// creates the node bucket if it doesn't exist, and either creates a
+// fresh root node or verifies the svalues of the root node already on
+// disk from a previous run. Init panics if the store cannot be written
+// or fails verification, consistent with the other invariant checks in
+// this package: a tree that can't prove its own state is correct on
+// startup shouldn't reconcile with peers.
+func (t *BoltPrefixTree) Init() {
+	if t.bitQuantum == 0 {
+		t.bitQuantum = DefaultBitQuantum
+	}
+	if t.splitThreshold == 0 {
+		t.splitThreshold = DefaultSplitThreshold
+	}
+	if t.joinThreshold == 0 {
+		t.joinThreshold = DefaultJoinThreshold
+	}
+	if t.mBar == 0 {
+		t.mBar = DefaultMBar
+	}
+	if t.numSamples == 0 {
+		t.numSamples = DefaultNumSamples
+	}
+	if t.Metrics == nil {
+		t.Metrics = NopMetrics{}
+	}
+	t.points = Zpoints(P_SKS, t.numSamples)
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(nodesBucket)
+		if err != nil {
+			return err
+		}
+		rootKey := encodeKey(NewBitstring(0))
+		if b.Get(rootKey) != nil {
+			return nil
+		}
+		return putNode(b, rootKey, t.newNodeRecord())
+	})
+	if err != nil {
+		panic(err)
+	}
+	t.nodeTotal = 0
+	t.nodeDepths = nil
+	if err := t.verifyNode(NewBitstring(0), 0); err != nil {
+		panic(err)
+	}
+}
+
+// addNodesAtDepth records the addition (n > 0) or removal (n < 0) of n
+// nodes at depth, keeping nodeTotal/nodeDepths consistent. Called once
+// per split (all new children at once) or once per node a join removes,
+// so nodeCount stays O(depth) instead of re-walking the store.
+func (t *BoltPrefixTree) addNodesAtDepth(depth, n int) {
+	for len(t.nodeDepths) <= depth {
+		t.nodeDepths = append(t.nodeDepths, 0)
+	}
+	t.nodeDepths[depth] += n
+	t.nodeTotal += n
+}
+
+// nodeCount returns the number of nodes in the tree and the tree's
+// depth, from the incremental counts addNodesAtDepth maintains.
+func (t *BoltPrefixTree) nodeCount() (nodes, depth int) {
+	nodes = t.nodeTotal
+	for d := len(t.nodeDepths) - 1; d >= 0; d-- {
+		if t.nodeDepths[d] > 0 {
+			depth = d
+			break
+		}
+	}
+	return
+}
+
+func (t *BoltPrefixTree) newNodeRecord() *boltNodeRecord {
+	rec := &boltNodeRecord{Leaf: true, SValues: make([][]byte, t.numSamples)}
+	one := Zi(P_SKS, 1)
+	for i := range rec.SValues {
+		rec.SValues[i] = one.Bytes()
+	}
+	return rec
+}
+
+// boltNodeRecord is the on-disk representation of a PrefixNode.
+type boltNodeRecord struct {
+	Leaf        bool
+	NumElements int
+	SValues     [][]byte
+	Elements    [][]byte
+}
+
+func putNode(b *bolt.Bucket, key []byte, rec *boltNodeRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	return b.Put(key, buf.Bytes())
+}
+
+func getNode(b *bolt.Bucket, key []byte) (*boltNodeRecord, error) {
+	data := b.Get(key)
+	if data == nil {
+		return nil, errors.New("recon: no such node")
+	}
+	rec := new(boltNodeRecord)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// encodeKey packs a Bitstring's bit length (4 bytes, big-endian) and
+// then its bits (bit i in byte i/8, at position i%8) into a byte slice
+// used as the node's Bolt key. Because the length comes first, a node's
+// key is not a byte-prefix of its children's keys; nodes are only ever
+// looked up by exact key.
+func encodeKey(bs *Bitstring) []byte {
+	n := bs.BitLen()
+	buf := make([]byte, 4, 4+(n+7)/8)
+	buf[0] = byte(n >> 24)
+	buf[1] = byte(n >> 16)
+	buf[2] = byte(n >> 8)
+	buf[3] = byte(n)
+	var cur byte
+	for i := 0; i < n; i++ {
+		if bs.Get(i) == 1 {
+			cur |= 1 << uint(i%8)
+		}
+		if i%8 == 7 {
+			buf = append(buf, cur)
+			cur = 0
+		}
+	}
+	if n%8 != 0 {
+		buf = append(buf, cur)
+	}
+	return buf
+}
+
+func childKey(bs *Bitstring, bitQuantum, childIndex int) *Bitstring {
+	child := NewBitstring(bs.BitLen() + bitQuantum)
+	for i := 0; i < bs.BitLen(); i++ {
+		if bs.Get(i) == 1 {
+			child.Set(i)
+		}
+	}
+	for j := 0; j < bitQuantum; j++ {
+		if (childIndex>>uint(j))&0x01 == 1 {
+			child.Set(bs.BitLen() + j)
+		}
+	}
+	return child
+}
+
+// BoltPrefixNode is a PrefixNode whose state is read from a
+// BoltPrefixTree's store. It is a point-in-time snapshot: callers that
+// need a consistent view across several nodes should take one inside a
+// single transaction rather than calling Node() repeatedly.
+type BoltPrefixNode struct {
+	tree *BoltPrefixTree
+	key  *Bitstring
+	rec  *boltNodeRecord
+}
+
+func (n *BoltPrefixNode) BitQuantum() int { return n.tree.BitQuantum() }
+
+func (n *BoltPrefixNode) Parent() (PrefixNode, bool) {
+	if n.key.BitLen() == 0 {
+		return nil, false
+	}
+	parentKey := NewBitstring(n.key.BitLen() - n.tree.BitQuantum())
+	for i := 0; i < parentKey.BitLen(); i++ {
+		if n.key.Get(i) == 1 {
+			parentKey.Set(i)
+		}
+	}
+	parent, err := n.tree.Node(parentKey)
+	if err != nil {
+		return nil, false
+	}
+	return parent, true
+}
+
+func (n *BoltPrefixNode) Key() *Bitstring { return n.key }
+
+func (n *BoltPrefixNode) Elements() []*Zp {
+	if n.IsLeaf() {
+		result := make([]*Zp, len(n.rec.Elements))
+		for i, eb := range n.rec.Elements {
+			result[i] = Zb(P_SKS, eb)
+		}
+		return result
+	}
+	var result []*Zp
+	for _, child := range n.Children() {
+		result = append(result, child.Elements()...)
+	}
+	return result
+}
+
+func (n *BoltPrefixNode) Size() int { return n.rec.NumElements }
+
+func (n *BoltPrefixNode) SValues() []*Zp {
+	result := make([]*Zp, len(n.rec.SValues))
+	for i, sb := range n.rec.SValues {
+		result[i] = Zb(P_SKS, sb)
+	}
+	return result
+}
+
+func (n *BoltPrefixNode) Children() (result []PrefixNode) {
+	if n.IsLeaf() {
+		return nil
+	}
+	numChildren := 1 << uint(n.BitQuantum())
+	for i := 0; i < numChildren; i++ {
+		child, err := n.tree.Node(childKey(n.key, n.BitQuantum(), i))
+		if err != nil {
+			continue
+		}
+		result = append(result, child)
+	}
+	return
+}
+
+func (n *BoltPrefixNode) IsLeaf() bool { return n.rec.Leaf }
+
+// Root returns the tree's root node.
+func (t *BoltPrefixTree) Root() (PrefixNode, error) { return t.Node(NewBitstring(0)) }
+
+// Node returns the node stored at the given key.
+func (t *BoltPrefixTree) Node(key *Bitstring) (PrefixNode, error) {
+	var rec *boltNodeRecord
+	err := t.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = getNode(tx.Bucket(nodesBucket), encodeKey(key))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltPrefixNode{tree: t, key: key, rec: rec}, nil
+}
+
+// Insert adds a Z/Zp integer into the prefix tree, splitting leaf
+// nodes that grow past SplitThreshold. The whole operation, including
+// any splits it triggers, commits as one Bolt transaction.
+func (t *BoltPrefixTree) Insert(z *Zp) error {
+	start := time.Now()
+	bs := NewBitstring(P_SKS.BitLen())
+	bs.SetBytes(ReverseBytes(z.Bytes()))
+	marray := AddElementArray(t, z)
+	var pending []Event
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		return t.insert(tx.Bucket(nodesBucket), z, marray, bs, NewBitstring(0), 0, &pending)
+	})
+	t.Metrics.InsertDuration(time.Since(start))
+	if err != nil {
+		return err
+	}
+	t.reportNodeCount(pending)
+	t.events.publish(Event{Type: Inserted, Element: z})
+	for _, e := range pending {
+		t.events.publish(e)
+	}
+	return nil
+}
+
+func (t *BoltPrefixTree) insert(b *bolt.Bucket, z *Zp, marray []*Zp, bs, key *Bitstring, depth int, pending *[]Event) error {
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return err
+	}
+	updateRecSvalues(rec, z, marray)
+	rec.NumElements++
+	if rec.Leaf {
+		if len(rec.Elements) > t.SplitThreshold() {
+			if err := putNode(b, encodeKey(key), rec); err != nil {
+				return err
+			}
+			if err := t.split(b, key, depth, pending); err != nil {
+				return err
+			}
+			// z itself wasn't one of the elements split() just moved;
+			// insert it into the child it now belongs in, the same
+			// way MemPrefixNode.insert falls through after split.
+			return t.insert(b, z, marray, bs, nextKey(key, bs, t.BitQuantum(), depth), depth+1, pending)
+		}
+		for _, eb := range rec.Elements {
+			if Zb(P_SKS, eb).Cmp(z) == 0 {
+				panic("Duplicate: " + z.String())
+			}
+		}
+		rec.Elements = append(rec.Elements, z.Bytes())
+		t.Metrics.LeafSize(len(rec.Elements))
+		return putNode(b, encodeKey(key), rec)
+	}
+	if err := putNode(b, encodeKey(key), rec); err != nil {
+		return err
+	}
+	return t.insert(b, z, marray, bs, nextKey(key, bs, t.BitQuantum(), depth), depth+1, pending)
+}
+
+// split converts a leaf node into an interior node, creating its
+// children and re-inserting its elements into them. Node records store
+// elements only, so split computes AddElementArray for every element it
+// moves and passes it to insertBatch along with the element; a child
+// that overflows and splits in turn computes it again for the elements
+// it moves. MemPrefixNode.split instead reuses its cached marrays.
+func (t *BoltPrefixTree) split(b *bolt.Bucket, key *Bitstring, depth int, pending *[]Event) error {
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return err
+	}
+	numChildren := 1 << uint(t.BitQuantum())
+	for i := 0; i < numChildren; i++ {
+		if err := putNode(b, encodeKey(childKey(key, t.BitQuantum(), i)), t.newNodeRecord()); err != nil {
+			return err
+		}
+	}
+	elements := rec.Elements
+	rec.Leaf = false
+	rec.Elements = nil
+	if err := putNode(b, encodeKey(key), rec); err != nil {
+		return err
+	}
+	childZs := make([][]*Zp, numChildren)
+	childMarrays := make([][][]*Zp, numChildren)
+	for _, eb := range elements {
+		element := Zb(P_SKS, eb)
+		ebs := NewBitstring(P_SKS.BitLen())
+		ebs.SetBytes(ReverseBytes(element.Bytes()))
+		idx := childIndexAt(ebs, t.BitQuantum(), depth)
+		childZs[idx] = append(childZs[idx], element)
+		childMarrays[idx] = append(childMarrays[idx], AddElementArray(t, element))
+	}
+	for i := 0; i < numChildren; i++ {
+		if err := t.insertBatch(b, childZs[i], childMarrays[i], childKey(key, t.BitQuantum(), i), depth+1, pending); err != nil {
+			return err
+		}
+	}
+	t.addNodesAtDepth(depth+1, numChildren)
+	t.Metrics.Split()
+	*pending = append(*pending, Event{Type: Split, Node: key})
+	return nil
+}
+
+// insertBatch commits a batch of elements already known to belong
+// under key into the tree rooted there, folding each node's svalue
+// contributions into one getNode/putNode pass per node on the path
+// rather than one per element. marrays holds each element's
+// AddElementArray, computed by the caller and passed down unchanged
+// through interior nodes. A leaf that holds more than SplitThreshold
+// elements once the batch is appended is split, and that split
+// recomputes AddElementArray for the elements it moves.
+func (t *BoltPrefixTree) insertBatch(b *bolt.Bucket, zs []*Zp, marrays [][]*Zp, key *Bitstring, depth int, pending *[]Event) error {
+	if len(zs) == 0 {
+		return nil
+	}
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return err
+	}
+	for i, z := range zs {
+		updateRecSvalues(rec, z, marrays[i])
+	}
+	rec.NumElements += len(zs)
+	if rec.Leaf {
+		for _, z := range zs {
+			rec.Elements = append(rec.Elements, z.Bytes())
+		}
+		if len(rec.Elements) > t.SplitThreshold() {
+			if err := putNode(b, encodeKey(key), rec); err != nil {
+				return err
+			}
+			return t.split(b, key, depth, pending)
+		}
+		t.Metrics.LeafSize(len(rec.Elements))
+		return putNode(b, encodeKey(key), rec)
+	}
+	if err := putNode(b, encodeKey(key), rec); err != nil {
+		return err
+	}
+	numChildren := 1 << uint(t.BitQuantum())
+	childZs := make([][]*Zp, numChildren)
+	childMarrays := make([][][]*Zp, numChildren)
+	for i, z := range zs {
+		zbs := NewBitstring(P_SKS.BitLen())
+		zbs.SetBytes(ReverseBytes(z.Bytes()))
+		idx := childIndexAt(zbs, t.BitQuantum(), depth)
+		childZs[idx] = append(childZs[idx], z)
+		childMarrays[idx] = append(childMarrays[idx], marrays[i])
+	}
+	for i := 0; i < numChildren; i++ {
+		if err := t.insertBatch(b, childZs[i], childMarrays[i], childKey(key, t.BitQuantum(), i), depth+1, pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportNodeCount emits a NodeCount metric if pending contains a Split
+// or Joined event, i.e. the tree's shape actually changed. It's called
+// after the Bolt transaction commits and reads the incremental counts
+// from nodeCount rather than walking the store. Those counts are
+// updated by split/join while the transaction runs and are not rolled
+// back if it fails.
+func (t *BoltPrefixTree) reportNodeCount(pending []Event) {
+	for _, e := range pending {
+		if e.Type == Split || e.Type == Joined {
+			nodes, depth := t.nodeCount()
+			t.Metrics.NodeCount(nodes, depth)
+			return
+		}
+	}
+}
+
+// Remove deletes a Z/Zp integer from the prefix tree, joining interior
+// nodes that fall to or below JoinThreshold. The whole operation,
+// including any joins it triggers, commits as one Bolt transaction.
+func (t *BoltPrefixTree) Remove(z *Zp) error {
+	start := time.Now()
+	bs := NewBitstring(P_SKS.BitLen())
+	bs.SetBytes(ReverseBytes(z.Bytes()))
+	marray := DelElementArray(t, z)
+	var pending []Event
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		return t.remove(tx.Bucket(nodesBucket), z, marray, bs, NewBitstring(0), 0, &pending)
+	})
+	t.Metrics.RemoveDuration(time.Since(start))
+	if err != nil {
+		return err
+	}
+	t.reportNodeCount(pending)
+	t.events.publish(Event{Type: Removed, Element: z})
+	for _, e := range pending {
+		t.events.publish(e)
+	}
+	return nil
+}
+
+func (t *BoltPrefixTree) remove(b *bolt.Bucket, z *Zp, marray []*Zp, bs, key *Bitstring, depth int, pending *[]Event) error {
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return err
+	}
+	updateRecSvalues(rec, z, marray)
+	rec.NumElements--
+	if !rec.Leaf {
+		if rec.NumElements <= t.JoinThreshold() {
+			if err := putNode(b, encodeKey(key), rec); err != nil {
+				return err
+			}
+			return t.join(b, key, z, depth, pending)
+		}
+		if err := putNode(b, encodeKey(key), rec); err != nil {
+			return err
+		}
+		return t.remove(b, z, marray, bs, nextKey(key, bs, t.BitQuantum(), depth), depth+1, pending)
+	}
+	rec.Elements, err = recWithRemoved(rec.Elements, z)
+	if err != nil {
+		return err
+	}
+	t.Metrics.LeafSize(len(rec.Elements))
+	return putNode(b, encodeKey(key), rec)
+}
+
+// join collapses an interior node's subtree back into a single leaf,
+// recursively gathering every descendant's elements (less z, the
+// element remove() is in the middle of removing, which is still
+// sitting in its leaf at this point) and deleting the descendant
+// records.
+func (t *BoltPrefixTree) join(b *bolt.Bucket, key *Bitstring, z *Zp, depth int, pending *[]Event) error {
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return err
+	}
+	elements, err := t.gatherAndDelete(b, key, depth)
+	if err != nil {
+		return err
+	}
+	// gatherAndDelete counted key's own record as removed along with its
+	// descendants, but key survives here as a leaf rather than
+	// disappearing, so restore its count.
+	t.addNodesAtDepth(depth, 1)
+	elements, err = recWithRemoved(elements, z)
+	if err != nil {
+		return err
+	}
+	rec.Leaf = true
+	rec.Elements = elements
+	t.Metrics.Join()
+	t.Metrics.LeafSize(len(elements))
+	if err := putNode(b, encodeKey(key), rec); err != nil {
+		return err
+	}
+	*pending = append(*pending, Event{Type: Joined, Node: key})
+	return nil
+}
+
+func (t *BoltPrefixTree) gatherAndDelete(b *bolt.Bucket, key *Bitstring, depth int) ([][]byte, error) {
+	rec, err := getNode(b, encodeKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if rec.Leaf {
+		if err := b.Delete(encodeKey(key)); err != nil {
+			return nil, err
+		}
+		t.addNodesAtDepth(depth, -1)
+		return rec.Elements, nil
+	}
+	var result [][]byte
+	numChildren := 1 << uint(t.BitQuantum())
+	for i := 0; i < numChildren; i++ {
+		sub, err := t.gatherAndDelete(b, childKey(key, t.BitQuantum(), i), depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sub...)
+	}
+	if err := b.Delete(encodeKey(key)); err != nil {
+		return nil, err
+	}
+	t.addNodesAtDepth(depth, -1)
+	return result, nil
+}
+
+func nextKey(key, bs *Bitstring, bitQuantum, depth int) *Bitstring {
+	childIndex := 0
+	for i := 0; i < bitQuantum; i++ {
+		if bs.Get(depth*bitQuantum+i) == 1 {
+			childIndex |= 1 << uint(i)
+		}
+	}
+	return childKey(key, bitQuantum, childIndex)
+}
+
+func updateRecSvalues(rec *boltNodeRecord, z *Zp, marray []*Zp) {
+	for i, mb := range marray {
+		sv := Zb(P_SKS, rec.SValues[i])
+		rec.SValues[i] = Z(z.P).Mul(sv, mb).Bytes()
+	}
+}
+
+func recWithRemoved(elements [][]byte, z *Zp) ([][]byte, error) {
+	var result [][]byte
+	var has bool
+	for _, eb := range elements {
+		if Zb(P_SKS, eb).Cmp(z) != 0 {
+			result = append(result, eb)
+		} else {
+			has = true
+		}
+	}
+	if !has {
+		return nil, fmt.Errorf("recon: remove non-existent element from node")
+	}
+	return result, nil
+}
+
+// verifyNode is the tree's recovery path: after opening a store left
+// over from a previous run, it walks a node's subtree bottom-up,
+// recomputing svalues from the leaves' elements and comparing them
+// against what's on disk, so corruption from a crash mid-write is
+// caught at startup rather than silently desyncing reconciliation. This
+// walk is also the only place nodeTotal/nodeDepths are seeded, since
+// unlike MemPrefixTree (which always starts empty), the store it walks
+// may already hold nodes from a previous run.
+func (t *BoltPrefixTree) verifyNode(key *Bitstring, depth int) error {
+	node, err := t.Node(key)
+	if err != nil {
+		return err
+	}
+	t.addNodesAtDepth(depth, 1)
+	if node.IsLeaf() {
+		want := t.newNodeRecord().SValues
+		wantZp := make([]*Zp, len(want))
+		for i := range wantZp {
+			wantZp[i] = Zi(P_SKS, 1)
+		}
+		for _, z := range node.Elements() {
+			marray := AddElementArray(t, z)
+			for i := range wantZp {
+				wantZp[i] = Z(z.P).Mul(wantZp[i], marray[i])
+			}
+		}
+		return compareSvalues(key, wantZp, node.SValues())
+	}
+	// An interior node's svalues are the product of its children's.
+	wantZp := make([]*Zp, t.numSamples)
+	for i := range wantZp {
+		wantZp[i] = Zi(P_SKS, 1)
+	}
+	for _, child := range node.Children() {
+		if err := t.verifyNode(child.Key(), depth+1); err != nil {
+			return err
+		}
+		for i, sv := range child.SValues() {
+			wantZp[i] = Z(sv.P).Mul(wantZp[i], sv)
+		}
+	}
+	return compareSvalues(key, wantZp, node.SValues())
+}
+
+func compareSvalues(key *Bitstring, want, got []*Zp) error {
+	if len(want) != len(got) {
+		return fmt.Errorf("recon: svalue count mismatch at node %v", key)
+	}
+	for i := range want {
+		if want[i].Cmp(got[i]) != 0 {
+			return fmt.Errorf("recon: svalue mismatch at node %v, sample %d", key, i)
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a stream of Events for every Insert, Remove, split
+// and join this tree commits.
+func (t *BoltPrefixTree) Subscribe() (<-chan Event, CancelFunc) { return t.events.Subscribe() }
+
+// EventCount returns the total number of events this tree has
+// published, including any that a full subscriber buffer dropped.
+// Dropped events are not counted separately, and the count is not
+// reported through Metrics.
+func (t *BoltPrefixTree) EventCount() uint64 { return t.events.EventCount() }
+
+// PublishReconStarted and PublishReconFinished let the recon protocol
+// loop (which drives this tree but lives outside it) feed gossip round
+// outcomes into the same event stream as tree mutations.
+func (t *BoltPrefixTree) PublishReconStarted(partner string) {
+	t.events.publish(Event{Type: ReconStarted, Partner: partner})
+}
+
+func (t *BoltPrefixTree) PublishReconFinished(partner string, added, removed int, err error) {
+	t.events.publish(Event{Type: ReconFinished, Partner: partner, Added: added, Removed: removed, Err: err})
+}
+
+// Close releases the underlying BoltDB file.
+func (t *BoltPrefixTree) Close() error { return t.db.Close() }
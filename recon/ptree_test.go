@@ -0,0 +1,155 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/cmars/conflux"
+)
+
+// Small thresholds so a handful of inserts are enough to exercise
+// split, and removing back down exercises join.
+const (
+	testSplitThreshold = 4
+	testJoinThreshold  = 2
+	testBitQuantum     = 2
+	testMBar           = 2
+)
+
+// checkConsistent checks that every leaf's Size matches its number of
+// Elements and every interior node's Size matches the sum of its
+// children's, and fails the test if the tree disagrees with itself.
+// SValues are not checked.
+func checkConsistent(t *testing.T, tree PrefixTree) {
+	t.Helper()
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatalf("Root: %v", err)
+	}
+	var walk func(n PrefixNode)
+	walk = func(n PrefixNode) {
+		if n.IsLeaf() {
+			if n.Size() != len(n.Elements()) {
+				t.Fatalf("node %v: Size()=%d but len(Elements())=%d", n.Key(), n.Size(), len(n.Elements()))
+			}
+			return
+		}
+		var childSum int
+		for _, child := range n.Children() {
+			childSum += child.Size()
+			walk(child)
+		}
+		if n.Size() != childSum {
+			t.Fatalf("node %v: Size()=%d but children sum to %d", n.Key(), n.Size(), childSum)
+		}
+	}
+	walk(root)
+}
+
+func testElements(n int) []*Zp {
+	zs := make([]*Zp, n)
+	for i := range zs {
+		zs[i] = Zi(P_SKS, 1000+i)
+	}
+	return zs
+}
+
+func TestMemPrefixTreeSplitJoin(t *testing.T) {
+	tree := &MemPrefixTree{
+		splitThreshold: testSplitThreshold,
+		joinThreshold:  testJoinThreshold,
+		bitQuantum:     testBitQuantum,
+		mBar:           testMBar,
+		numSamples:     testMBar + 1,
+	}
+	tree.Init()
+
+	elements := testElements(tree.SplitThreshold() + 4)
+	for _, z := range elements {
+		if err := tree.Insert(z); err != nil {
+			t.Fatalf("Insert(%v): %v", z, err)
+		}
+	}
+	checkConsistent(t, tree)
+
+	for _, z := range elements {
+		if err := tree.Remove(z); err != nil {
+			t.Fatalf("Remove(%v): %v", z, err)
+		}
+	}
+	checkConsistent(t, tree)
+
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatalf("Root: %v", err)
+	}
+	if root.Size() != 0 {
+		t.Fatalf("expected empty tree after removing every element, got Size()=%d", root.Size())
+	}
+}
+
+func TestBoltPrefixTreeSplitJoin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflux-ptree-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree, err := NewBoltPrefixTree(filepath.Join(dir, "ptree.db"))
+	if err != nil {
+		t.Fatalf("NewBoltPrefixTree: %v", err)
+	}
+	defer tree.Close()
+	tree.splitThreshold = testSplitThreshold
+	tree.joinThreshold = testJoinThreshold
+	tree.bitQuantum = testBitQuantum
+	tree.mBar = testMBar
+	tree.numSamples = testMBar + 1
+	tree.Init()
+
+	elements := testElements(tree.SplitThreshold() + 4)
+	for _, z := range elements {
+		if err := tree.Insert(z); err != nil {
+			t.Fatalf("Insert(%v): %v", z, err)
+		}
+	}
+	checkConsistent(t, tree)
+
+	for _, z := range elements {
+		if err := tree.Remove(z); err != nil {
+			t.Fatalf("Remove(%v): %v", z, err)
+		}
+	}
+	checkConsistent(t, tree)
+
+	root, err := tree.Root()
+	if err != nil {
+		t.Fatalf("Root: %v", err)
+	}
+	if root.Size() != 0 {
+		t.Fatalf("expected empty tree after removing every element, got Size()=%d", root.Size())
+	}
+}
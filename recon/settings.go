@@ -22,6 +22,11 @@ type Settings struct {
 	NumSamples                  int
 	GossipIntervalSecs          int
 	MaxOutstandingReconRequests int
+	// Metrics receives instrumentation from the tree and recon
+	// protocol. Defaults to NopMetrics; embedders that want
+	// Prometheus output should set it to a *PrometheusMetrics, and
+	// embedders with a different sink can implement Metrics directly.
+	Metrics Metrics
 }
 
 func NewSettings() *Settings {
@@ -34,7 +39,8 @@ func NewSettings() *Settings {
 		BitQuantum:                  DefaultBitQuantum,
 		MBar:                        DefaultMBar,
 		GossipIntervalSecs:          60,
-		MaxOutstandingReconRequests: 100}
+		MaxOutstandingReconRequests: 100,
+		Metrics:                     NopMetrics{}}
 	s.updateDerived()
 	return s
 }